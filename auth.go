@@ -0,0 +1,55 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+)
+
+// credentials is a pluggable source for AUTH PLAIN checks. The first cut
+// backing it is a flat htpasswd-style "user:pass" file; a real deployment
+// would want bcrypt hashes, but plaintext is enough to unblock SMTP AUTH
+// and POP3 login sharing one account.
+var credentials = struct {
+	sync.RWMutex
+	users map[string]string
+}{users: map[string]string{}}
+
+func loadCredentials(path string) {
+	if path == "" {
+		return
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	defer f.Close()
+
+	users := map[string]string{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		users[parts[0]] = parts[1]
+	}
+
+	credentials.Lock()
+	credentials.users = users
+	credentials.Unlock()
+}
+
+func checkCredential(user, pass string) bool {
+	credentials.RLock()
+	defer credentials.RUnlock()
+	want, exists := credentials.users[user]
+	return exists && want == pass
+}
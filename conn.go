@@ -0,0 +1,357 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/textproto"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// state tracks where a connection is in the SMTP dialogue so that
+// out-of-order verbs (e.g. DATA before MAIL) can be rejected instead of
+// silently accepted.
+type state int
+
+const (
+	stateNew state = iota
+	stateInitial
+	stateMail
+	stateRecipient
+	stateData
+)
+
+// RFC 5321 section 4.5.3.1 line-length limits.
+const maxCommandLineLength = 512
+const maxDataLineLength = 1000
+
+var errLineTooLong = fmt.Errorf("line exceeds RFC 5321 length limit")
+
+// lineLengthLimiter enforces the per-line length limit on DATA content
+// that textproto.DotReader, which only handles dot-stuffing, does not.
+type lineLengthLimiter struct {
+	r       io.Reader
+	maxLine int
+	curLine int
+}
+
+func (l *lineLengthLimiter) Read(p []byte) (int, error) {
+	n, err := l.r.Read(p)
+	for _, b := range p[:n] {
+		if b == '\n' {
+			l.curLine = 0
+			continue
+		}
+		l.curLine++
+		if l.curLine > l.maxLine {
+			return n, errLineTooLong
+		}
+	}
+	return n, err
+}
+
+// connection wraps a single client connection and everything learned about
+// it over the course of the SMTP dialogue: whether it EHLO'd, whether it
+// upgraded to TLS, and what (if anything) it authenticated as.
+type connection struct {
+	conn  net.Conn
+	tp    *textproto.Conn
+	state state
+
+	remoteIP string
+	esmtp    bool
+	tls      bool
+	authc    string
+
+	from    string
+	to      string
+	discard bool
+}
+
+func newConnection(conn net.Conn) *connection {
+	return &connection{
+		conn:     conn,
+		tp:       textproto.NewConn(conn),
+		state:    stateNew,
+		remoteIP: toIPAddress(conn.RemoteAddr()),
+	}
+}
+
+func (c *connection) reply(code int, msg string) error {
+	if c.discard && tarpitDelay > 0 {
+		time.Sleep(tarpitDelay)
+	}
+	return c.tp.PrintfLine("%d %s", code, msg)
+}
+
+func (c *connection) replyMultiline(code int, lines ...string) error {
+	for i, line := range lines {
+		sep := byte('-')
+		if i == len(lines)-1 {
+			sep = ' '
+		}
+		if err := c.tp.PrintfLine("%d%c%s", code, sep, line); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// capabilities are advertised in response to EHLO. STARTTLS is withheld
+// once the connection is already running over TLS, and AUTH is withheld
+// until the connection is.
+func (c *connection) capabilities() []string {
+	caps := []string{"8BITMIME", fmt.Sprintf("SIZE %d", maxMessageSize)}
+	if !c.tls {
+		caps = append(caps, "STARTTLS")
+	}
+	if c.tls {
+		caps = append(caps, "AUTH PLAIN")
+	}
+	return caps
+}
+
+func (c *connection) serve() {
+	defer c.conn.Close()
+
+	if spamDetection && isSpammerAddr(c.conn.RemoteAddr()) {
+		fmt.Printf("discarding mail from %v\n", c.conn.RemoteAddr())
+		return
+	}
+	fmt.Printf("receiving mail from %v\n", c.conn.RemoteAddr())
+
+	if err := c.reply(220, "mail.lf.lc ESMTP dumptruck"); err != nil {
+		return
+	}
+	c.state = stateInitial
+
+	for {
+		line, err := c.tp.ReadLine()
+		if err != nil {
+			return
+		}
+		if len(line) > maxCommandLineLength {
+			c.reply(500, "line too long")
+			continue
+		}
+
+		args := strings.SplitN(strings.TrimSpace(line), " ", 2)
+		verb := strings.ToUpper(args[0])
+		var arg string
+		if len(args) > 1 {
+			arg = args[1]
+		}
+
+		switch verb {
+		case "EHLO", "HELO":
+			c.esmtp = verb == "EHLO"
+			c.state = stateInitial
+			if c.esmtp {
+				c.replyMultiline(250, append([]string{"mail.lf.lc"}, c.capabilities()...)...)
+			} else {
+				c.reply(250, "mail.lf.lc")
+			}
+		case "STARTTLS":
+			if !c.handleStartTLS() {
+				return
+			}
+		case "AUTH":
+			c.handleAuth(arg)
+		case "MAIL":
+			if c.state < stateInitial {
+				c.reply(503, "say HELO/EHLO first")
+				continue
+			}
+			c.from = sanitizeAddr("MAIL " + arg)
+			c.state = stateMail
+			c.reply(250, "yes sir")
+		case "RCPT":
+			if c.state < stateMail {
+				c.reply(503, "need MAIL FROM first")
+				continue
+			}
+			c.to = sanitizeAddr("RCPT " + arg)
+			c.discard = !recipientAllowed(c.to)
+			c.state = stateRecipient
+			c.reply(250, "yes sir")
+		case "DATA":
+			if c.state < stateRecipient {
+				c.reply(503, "need RCPT TO first")
+				continue
+			}
+			c.handleData()
+			c.state = stateInitial
+		case "RSET":
+			c.from, c.to = "", ""
+			c.state = stateInitial
+			c.reply(250, "yes sir")
+		case "NOOP":
+			c.reply(250, "yes sir")
+		case "VRFY":
+			c.reply(250, "yes sir")
+		case "QUIT":
+			c.reply(221, "goodbye")
+			return
+		default:
+			c.reply(502, "*shrugs*")
+		}
+	}
+}
+
+// handleStartTLS upgrades the connection in place. It reports false when
+// the connection should be torn down instead of returning to the command
+// loop: once the client has seen "220 go ahead" it starts writing TLS
+// handshake bytes to the socket, so a failed handshake leaves the
+// plaintext textproto.Conn desynchronized and unsafe to keep reading from.
+func (c *connection) handleStartTLS() bool {
+	if c.tls {
+		c.reply(503, "already running TLS")
+		return true
+	}
+	if tlsCert == "" || tlsKey == "" {
+		c.reply(454, "TLS not available")
+		return true
+	}
+	cert, err := tls.LoadX509KeyPair(tlsCert, tlsKey)
+	if err != nil {
+		c.reply(454, "TLS not available")
+		return true
+	}
+	if err := c.reply(220, "go ahead"); err != nil {
+		return false
+	}
+
+	tlsConn := tls.Server(c.conn, &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err := tlsConn.Handshake(); err != nil {
+		return false
+	}
+	c.conn = tlsConn
+	c.tp = textproto.NewConn(tlsConn)
+	c.tls = true
+	c.state = stateInitial
+	return true
+}
+
+// handleAuth implements AUTH PLAIN as described in RFC 4616: a single
+// base64 blob of authzid\0authcid\0passwd. AUTH is refused until the
+// connection is running over TLS so credentials are never sent in the
+// clear.
+func (c *connection) handleAuth(arg string) {
+	if !c.tls {
+		c.reply(538, "encryption required for requested authentication mechanism")
+		return
+	}
+	fields := strings.Fields(arg)
+	if len(fields) == 0 || !strings.EqualFold(fields[0], "PLAIN") {
+		c.reply(504, "unrecognized authentication type")
+		return
+	}
+
+	blob := ""
+	if len(fields) > 1 {
+		blob = fields[1]
+	} else {
+		if err := c.reply(334, ""); err != nil {
+			return
+		}
+		line, err := c.tp.ReadLine()
+		if err != nil {
+			return
+		}
+		blob = line
+	}
+
+	decoded, err := base64.StdEncoding.DecodeString(blob)
+	if err != nil {
+		c.reply(501, "invalid base64")
+		return
+	}
+	parts := strings.SplitN(string(decoded), "\x00", 3)
+	if len(parts) != 3 {
+		c.reply(501, "malformed AUTH PLAIN response")
+		return
+	}
+	authcid, passwd := parts[1], parts[2]
+
+	if !checkCredential(authcid, passwd) {
+		c.reply(535, "authentication failed")
+		return
+	}
+	c.authc = authcid
+	c.reply(235, "authentication successful")
+}
+
+func (c *connection) handleData() {
+	if err := c.reply(354, "fill 'er up"); err != nil {
+		return
+	}
+
+	if c.discard {
+		// Matching recipients get the real pipeline; non-matching ones are
+		// tarpitted: we still have to read the DATA so the connection stays
+		// in sync, but it's thrown away instead of touching outputDirectory.
+		dr := c.tp.DotReader()
+		io.Copy(ioutil.Discard, dr)
+		atomic.AddInt64(&discardedCount, 1)
+		c.reply(250, "yes sir")
+		return
+	}
+
+	output, err := newMessageFile()
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	defer output.cleanup()
+
+	fmt.Fprintf(output.file, "Received: from %s by mail.lf.lc with %s%s%s;\r\n",
+		c.remoteIP, esmtpName(c.esmtp), tlsSuffix(c.tls), authSuffix(c.authc))
+
+	dr := c.tp.DotReader()
+	limited := &lineLengthLimiter{r: dr, maxLine: maxDataLineLength}
+	n, err := io.Copy(output.file, io.LimitReader(limited, maxMessageSize+1))
+	if err != nil {
+		if err != errLineTooLong {
+			c.reply(451, "error reading message")
+			return
+		}
+		io.Copy(ioutil.Discard, dr) // stay in sync with the client past the rejected data
+		c.reply(500, "line too long")
+		return
+	}
+	if n > maxMessageSize {
+		io.Copy(ioutil.Discard, dr)
+		c.reply(552, "message exceeds fixed maximum message size")
+		return
+	}
+
+	output.commit(c.to, c.remoteIP, c.esmtp, c.tls, c.authc)
+	atomic.AddInt64(&acceptedCount, 1)
+	c.reply(250, "yes sir")
+}
+
+func esmtpName(esmtp bool) string {
+	if esmtp {
+		return "ESMTP"
+	}
+	return "SMTP"
+}
+
+func tlsSuffix(tlsOn bool) string {
+	if tlsOn {
+		return "S"
+	}
+	return ""
+}
+
+func authSuffix(authc string) string {
+	if authc == "" {
+		return ""
+	}
+	return " (authenticated as " + authc + ")"
+}
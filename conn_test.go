@@ -0,0 +1,162 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/textproto"
+	"path"
+	"strings"
+	"testing"
+)
+
+// TestHandleDataPreservesLeadingDotLine guards against the bug this series
+// was written to fix: a DATA line that merely starts with "." (quoted
+// diffs, base64 with a leading period, ...) must survive intact instead of
+// being mistaken for the end-of-data terminator.
+func TestHandleDataPreservesLeadingDotLine(t *testing.T) {
+	outputDirectory = t.TempDir()
+	messageFormat = "raw"
+	maxMessageSize = 10 * 1024 * 1024
+	spamDetection = false
+	recipientAllowlist.entries = nil
+
+	server, client := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		newConnection(server).serve()
+		close(done)
+	}()
+
+	tp := textproto.NewConn(client)
+	expectReply := func() string {
+		line, err := tp.ReadLine()
+		if err != nil {
+			t.Fatalf("reading reply: %v", err)
+		}
+		return line
+	}
+	expectReply() // 220 banner
+
+	tp.PrintfLine("EHLO test")
+	for {
+		line := expectReply()
+		if len(line) < 4 || line[3] != '-' {
+			break // last line of the multiline 250
+		}
+	}
+
+	tp.PrintfLine("MAIL FROM:<a@b.com>")
+	expectReply()
+	tp.PrintfLine("RCPT TO:<c@d.com>")
+	expectReply()
+	tp.PrintfLine("DATA")
+	expectReply()
+
+	dw := tp.DotWriter()
+	fmt.Fprintf(dw, "Subject: test\r\n\r\nHello\r\n.this line really starts with one dot\r\nBye\r\n")
+	dw.Close()
+	expectReply() // 250 after end-of-data
+
+	tp.PrintfLine("QUIT")
+	expectReply() // 221
+	client.Close()
+	<-done
+
+	entries, err := ioutil.ReadDir(outputDirectory)
+	if err != nil {
+		t.Fatalf("reading output dir: %v", err)
+	}
+	var body []byte
+	for _, entry := range entries {
+		if strings.HasSuffix(entry.Name(), ".txt") {
+			body, err = ioutil.ReadFile(path.Join(outputDirectory, entry.Name()))
+			if err != nil {
+				t.Fatalf("reading message: %v", err)
+			}
+		}
+	}
+	if body == nil {
+		t.Fatal("no message was persisted")
+	}
+	if !strings.Contains(string(body), ".this line really starts with one dot") {
+		t.Errorf("leading-dot line was corrupted, got:\n%s", body)
+	}
+	if !strings.Contains(string(body), "Bye") {
+		t.Errorf("message was truncated at the leading-dot line, got:\n%s", body)
+	}
+}
+
+func TestHandleAuthRequiresTLS(t *testing.T) {
+	server, client := net.Pipe()
+	c := newConnection(server)
+
+	go c.handleAuth("PLAIN " + base64.StdEncoding.EncodeToString([]byte("\x00alice\x00secret")))
+
+	tp := textproto.NewConn(client)
+	line, err := tp.ReadLine()
+	if err != nil {
+		t.Fatalf("reading reply: %v", err)
+	}
+	if !strings.HasPrefix(line, "538") {
+		t.Errorf("expected 538 encryption-required reply, got %q", line)
+	}
+}
+
+func TestHandleAuthPlainSuccess(t *testing.T) {
+	f, err := ioutil.TempFile(t.TempDir(), "htpasswd")
+	if err != nil {
+		t.Fatalf("creating auth file: %v", err)
+	}
+	fmt.Fprintln(f, "alice:secret")
+	f.Close()
+	loadCredentials(f.Name())
+	defer loadCredentials("")
+
+	server, client := net.Pipe()
+	c := newConnection(server)
+	c.tls = true
+
+	blob := base64.StdEncoding.EncodeToString([]byte("\x00alice\x00secret"))
+	go c.handleAuth("PLAIN " + blob)
+
+	tp := textproto.NewConn(client)
+	line, err := tp.ReadLine()
+	if err != nil {
+		t.Fatalf("reading reply: %v", err)
+	}
+	if !strings.HasPrefix(line, "235") {
+		t.Errorf("expected 235 authentication-successful reply, got %q", line)
+	}
+	if c.authc != "alice" {
+		t.Errorf("expected authc to be recorded as alice, got %q", c.authc)
+	}
+}
+
+func TestHandleAuthPlainWrongPassword(t *testing.T) {
+	f, err := ioutil.TempFile(t.TempDir(), "htpasswd")
+	if err != nil {
+		t.Fatalf("creating auth file: %v", err)
+	}
+	fmt.Fprintln(f, "alice:secret")
+	f.Close()
+	loadCredentials(f.Name())
+	defer loadCredentials("")
+
+	server, client := net.Pipe()
+	c := newConnection(server)
+	c.tls = true
+
+	blob := base64.StdEncoding.EncodeToString([]byte("\x00alice\x00wrong"))
+	go c.handleAuth("PLAIN " + blob)
+
+	tp := textproto.NewConn(client)
+	line, err := tp.ReadLine()
+	if err != nil {
+		t.Fatalf("reading reply: %v", err)
+	}
+	if !strings.HasPrefix(line, "535") {
+		t.Errorf("expected 535 authentication-failed reply, got %q", line)
+	}
+}
@@ -1,105 +1,19 @@
 package main
 
-import "net"
-import "fmt"
-import "log"
-import "flag"
-import "path"
-import "strings"
-import "regexp"
-import "io"
-import "io/ioutil"
-import "os"
-import "time"
-
-type ReplyCode string
-type Command int
-
-const (
-	ReplyServiceReady          ReplyCode = "220 mail.lf.lc ESMTP dumptruck"
-	ReplyServiceClosing        ReplyCode = "221 goodbye"
-	ReplyOkay                  ReplyCode = "250 yes sir"
-	ReplyStartMailInput        ReplyCode = "354 fill 'er up"
-	ReplyServiceNotAvailable   ReplyCode = "421 not at the moment"
-	ReplyCommandNotImplemented ReplyCode = "502 *shrugs*"
-)
-
-const (
-	CommandEhlo Command = iota
-	CommandHelo
-	CommandMail
-	CommandRcpt
-	CommandData
-	CommandRset
-	CommandVrfy
-	CommandExpn
-	CommandHelp
-	CommandNoop
-	CommandQuit
+import (
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+	"time"
 )
 
-var replyTable = map[Command]ReplyCode{
-	CommandEhlo: ReplyOkay,
-	CommandMail: ReplyOkay,
-	CommandRcpt: ReplyOkay,
-	CommandData: ReplyStartMailInput,
-	CommandRset: ReplyOkay,
-	CommandVrfy: ReplyOkay,
-	CommandExpn: ReplyCommandNotImplemented,
-	CommandHelp: ReplyCommandNotImplemented,
-	CommandNoop: ReplyOkay,
-	CommandQuit: ReplyServiceClosing,
-}
-
-var commandTable = map[string]Command{
-	"EHLO": CommandEhlo,
-	"HELO": CommandEhlo,
-	"MAIL": CommandMail,
-	"RCPT": CommandRcpt,
-	"DATA": CommandData,
-	"RSET": CommandRset,
-	"VRFY": CommandVrfy,
-	"EXPN": CommandExpn,
-	"HELP": CommandHelp,
-	"NOOP": CommandNoop,
-	"QUIT": CommandQuit,
-}
-
-func readCommand(conn net.Conn, buf []byte) (int, error) {
-	datum := make([]byte, 1)
-	length := 0
-	for {
-		bytesRead, err := conn.Read(datum)
-		if err != nil {
-			return 0, err
-		}
-		if bytesRead == 1 && length < cap(buf) {
-			buf[length] = datum[0]
-			length += bytesRead
-			if datum[0] == '\n' {
-				return length, nil
-			}
-		}
-	}
-}
-
-func replyCommand(conn net.Conn, line string) Command {
-	line = strings.TrimSpace(line)
-	args := strings.Split(line, " ")
-	cmd, exists := commandTable[strings.ToUpper(args[0])]
-	if exists {
-		reply, exists := replyTable[cmd]
-		if exists {
-			fmt.Fprintln(conn, reply)
-		} else {
-			fmt.Fprintln(conn, ReplyCommandNotImplemented)
-		}
-	} else {
-		fmt.Fprintln(conn, ReplyOkay)
-	}
-	return cmd
-}
-
 func toIPAddress(addr net.Addr) string {
 	ipAddress := strings.Split(addr.String(), ":")[0]
 	dots := strings.Split(ipAddress, ".")
@@ -140,120 +54,151 @@ func sanitizeAddr(dirty string) string {
 	}
 }
 
-func copyFileContents(src, dst string) error {
-	in, err := os.Open(src)
-	if err != nil {
-		return err
-	}
-	defer in.Close()
-	out, err := os.Create(dst)
-	if err != nil {
-		return err
-	}
-	defer out.Close()
-	_, err = io.Copy(out, in)
-	cerr := out.Close()
+var messageNameFormat = "%v-%v-%v.txt"
+
+// messageFile is a single in-flight DATA transfer: content is staged to a
+// temp file and only promoted into outputDirectory once the transaction
+// completes successfully.
+type messageFile struct {
+	file *os.File
+}
+
+func newMessageFile() (*messageFile, error) {
+	f, err := ioutil.TempFile("/tmp", "maildump")
 	if err != nil {
-		return err
+		return nil, err
 	}
-	return cerr
+	return &messageFile{file: f}, nil
 }
 
-var messageNameFormat = "%v-%v-%v.txt"
-
-func handleConn(conn net.Conn) {
-	defer conn.Close()
+func (m *messageFile) cleanup() {
+	m.file.Close()
+	os.Remove(m.file.Name())
+}
 
-	if spamDetection && isSpammerAddr(conn.RemoteAddr()) {
-		fmt.Printf("discarding mail from %v\n", conn.RemoteAddr())
+// commit promotes the staged message into outputDirectory, recording the
+// ESMTP/TLS/AUTH state of the connection in a sidecar .meta file so
+// operators can tell authenticated/encrypted mail from anonymous mail.
+func (m *messageFile) commit(toAddr, remoteIP string, esmtp, tlsOn bool, authc string) {
+	m.file.Sync()
+	stats, err := m.file.Stat()
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	if stats.Size() <= 50 {
 		return
-	} else {
-		fmt.Printf("receiving mail from %v\n", conn.RemoteAddr())
 	}
 
-	output, err := ioutil.TempFile("/tmp", "maildump")
-	if err != nil {
+	messageName := fmt.Sprintf(messageNameFormat, toAddr, remoteIP, time.Now().Unix())
+
+	// The raw copy is persisted regardless of -format: POP3 retrieval
+	// enumerates outputDirectory for flat files, and it's the fallback if
+	// MIME parsing below fails, so "mime"-only must never mean the message
+	// only exists as a subdirectory (or not at all on a parse error).
+	mailPath := path.Join(outputDirectory, messageName)
+	if err := copyFileContents(m.file.Name(), mailPath); err != nil {
 		fmt.Println(err)
 		return
 	}
-	defer output.Close()
-	defer os.Remove(output.Name())
-
-	var toAddr = defaultAddr
-	remoteIP := toIPAddress(conn.RemoteAddr())
 
-	_, err = conn.Write([]byte("220 mail.lf.lc ESMTP dumptruck\n"))
+	meta, err := os.Create(mailPath + ".meta")
 	if err != nil {
 		fmt.Println(err)
 		return
 	}
+	defer meta.Close()
+	fmt.Fprintf(meta, "esmtp=%v\ntls=%v\nauth=%v\n", esmtp, tlsOn, authc)
 
-	rawData := make([]byte, 1024)
-	readingData := false
-
-CommandParse:
-	for {
-		bytesRead, err := readCommand(conn, rawData)
-		if err != nil {
-			break
-		}
-		output.Write(rawData[:bytesRead])
-
-		if readingData && rawData[0] == '.' {
-			readingData = false
-		}
-
-		if !readingData {
-			data := string(rawData[:bytesRead])
-			cmd := replyCommand(conn, data)
-			switch cmd {
-			case CommandMail:
-				break
-			case CommandRcpt:
-				toAddr = sanitizeAddr(data)
-				break
-			case CommandData:
-				readingData = true
-				break
-			case CommandQuit:
-				break CommandParse
-			}
+	if messageFormat == "mime" || messageFormat == "both" {
+		destDir := path.Join(outputDirectory, strings.TrimSuffix(messageName, ".txt"))
+		if err := parseMIME(m.file.Name(), destDir); err != nil {
+			fmt.Println(err)
 		}
 	}
-	output.Sync()
+}
 
-	stats, err := output.Stat()
-	output.Close()
+func copyFileContents(src, dst string) error {
+	in, err := os.Open(src)
 	if err != nil {
-		fmt.Println(err)
-		return
+		return err
 	}
-	if stats.Size() > 50 {
-		messageName := fmt.Sprintf(messageNameFormat, toAddr, remoteIP, time.Now().Unix())
-		mailPath := path.Join(outputDirectory, messageName)
-		err = copyFileContents(output.Name(), mailPath)
-		if err != nil {
-			fmt.Println(err)
-			return
-		}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	_, err = io.Copy(out, in)
+	cerr := out.Close()
+	if err != nil {
+		return err
 	}
+	return cerr
 }
 
 var outputDirectory string
 var listeningPort string
 var spamDetection bool
-
+var tlsCert string
+var tlsKey string
+var authFile string
+var maxMessageSize int64 = 10 * 1024 * 1024
+var messageFormat string
+var recipientsFile string
+var tarpitDelay time.Duration
+var metricsAddr string
+
+// main dispatches to the "serve" (default) and "sendmail" subcommands, the
+// way git or go itself do: a recognized verb as the first argument selects
+// the subcommand, otherwise the legacy flat-flags invocation is assumed.
 func main() {
-	flag.StringVar(&outputDirectory, "output", "/srv/http/maildump", "output directory for mail")
-	flag.StringVar(&listeningPort, "port", ":25", "listening port")
-	flag.BoolVar(&spamDetection, "spam", true, "perform spam detection")
-	flag.Parse()
+	if len(os.Args) > 1 && os.Args[1] == "sendmail" {
+		sendmailMain(os.Args[2:])
+		return
+	}
+
+	args := os.Args[1:]
+	if len(os.Args) > 1 && os.Args[1] == "serve" {
+		args = os.Args[2:]
+	}
+	serveMain(args)
+}
+
+func serveMain(args []string) {
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	fs.StringVar(&outputDirectory, "output", "/srv/http/maildump", "output directory for mail")
+	fs.StringVar(&listeningPort, "port", ":25", "listening port")
+	fs.BoolVar(&spamDetection, "spam", true, "perform spam detection")
+	fs.StringVar(&tlsCert, "tls-cert", "", "TLS certificate for STARTTLS")
+	fs.StringVar(&tlsKey, "tls-key", "", "TLS private key for STARTTLS")
+	fs.StringVar(&authFile, "auth-file", "", "htpasswd-style user:pass file for AUTH PLAIN")
+	fs.StringVar(&pop3Port, "pop3-port", ":110", "POP3 listening port")
+	fs.BoolVar(&pop3TLS, "pop3-tls", false, "require TLS for the POP3 listener (uses -tls-cert/-tls-key)")
+	fs.StringVar(&messageFormat, "format", "raw", "how to persist received mail: raw, mime, or both")
+	fs.StringVar(&recipientsFile, "recipients", "", "file of allowed local@domain addresses (supports *@domain); unmatched mail is silently discarded")
+	fs.DurationVar(&tarpitDelay, "tarpit", 0, "delay before each reply on the discard path, to cost spammers time")
+	fs.StringVar(&metricsAddr, "metrics", "", "optional address to serve accepted/discarded counters on, e.g. :9090")
+	fs.Int64Var(&maxMessageSize, "max-message-size", maxMessageSize, "maximum accepted message size in bytes, advertised via SIZE in EHLO")
+	fs.Parse(args)
+
+	switch messageFormat {
+	case "raw", "mime", "both":
+	default:
+		log.Fatalf("invalid -format %q: must be raw, mime, or both", messageFormat)
+	}
 
 	err := os.MkdirAll(outputDirectory, 0400)
 	if err != nil {
 		log.Fatal(err)
 	}
 
+	loadCredentials(authFile)
+	loadRecipients(recipientsFile)
+
+	go runPOP3Server()
+	go runMetricsServer(metricsAddr)
+
 	ln, err := net.Listen("tcp", listeningPort)
 	if err != nil {
 		log.Fatal(err)
@@ -266,6 +211,6 @@ func main() {
 		if err != nil {
 			fmt.Println(err)
 		}
-		go handleConn(conn)
+		go newConnection(conn).serve()
 	}
 }
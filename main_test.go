@@ -0,0 +1,31 @@
+package main
+
+import (
+	"testing"
+)
+
+// TestCommitAlwaysPersistsRawCopy guards against -format=mime silently
+// making mail unreachable over POP3 (which only enumerates flat files in
+// outputDirectory) and against MIME parse failures losing mail outright.
+func TestCommitAlwaysPersistsRawCopy(t *testing.T) {
+	outputDirectory = t.TempDir()
+	messageFormat = "mime"
+	defer func() { messageFormat = "raw" }()
+
+	m, err := newMessageFile()
+	if err != nil {
+		t.Fatalf("newMessageFile: %v", err)
+	}
+	defer m.cleanup()
+	m.file.WriteString("Subject: test\r\n\r\nhello world, this is long enough to persist\r\n")
+
+	m.commit("user.example.com", "1.2.3.4", true, true, "")
+
+	messages, err := snapshotMaildrop()
+	if err != nil {
+		t.Fatalf("snapshotMaildrop: %v", err)
+	}
+	if len(messages) != 1 {
+		t.Fatalf("expected the raw copy to be visible to POP3 in mime mode, got %d messages", len(messages))
+	}
+}
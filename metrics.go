@@ -0,0 +1,22 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"sync/atomic"
+)
+
+var acceptedCount int64
+var discardedCount int64
+
+func runMetricsServer(addr string) {
+	if addr == "" {
+		return
+	}
+	http.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "maildump_accepted_total %d\n", atomic.LoadInt64(&acceptedCount))
+		fmt.Fprintf(w, "maildump_discarded_total %d\n", atomic.LoadInt64(&discardedCount))
+	})
+	log.Println(http.ListenAndServe(addr, nil))
+}
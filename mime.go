@@ -0,0 +1,179 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// messageHeaders is the subset of RFC 5322 headers worth surfacing
+// separately from the body, written out as headers.json.
+type messageHeaders struct {
+	From      string `json:"from"`
+	To        string `json:"to"`
+	Subject   string `json:"subject"`
+	Date      string `json:"date"`
+	MessageID string `json:"message_id"`
+	InReplyTo string `json:"in_reply_to,omitempty"`
+}
+
+var attachmentNameSanitizer = regexp.MustCompile(`[^a-zA-Z0-9._-]+`)
+
+func sanitizeFilename(name string) string {
+	if name == "" {
+		return "attachment"
+	}
+	return attachmentNameSanitizer.ReplaceAllString(path.Base(name), "_")
+}
+
+// parseMIME reads the raw RFC 5322 message at rawPath and writes it back
+// out as a structured directory: headers.json, body.txt/body.html, and
+// attachments/<sanitized-filename> for anything else.
+func parseMIME(rawPath, destDir string) error {
+	f, err := os.Open(rawPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	msg, err := mail.ReadMessage(f)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(destDir, 0700); err != nil {
+		return err
+	}
+
+	headers := messageHeaders{
+		From:      msg.Header.Get("From"),
+		To:        msg.Header.Get("To"),
+		Subject:   msg.Header.Get("Subject"),
+		Date:      msg.Header.Get("Date"),
+		MessageID: msg.Header.Get("Message-Id"),
+		InReplyTo: msg.Header.Get("In-Reply-To"),
+	}
+	headersJSON, err := json.MarshalIndent(headers, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(path.Join(destDir, "headers.json"), headersJSON, 0600); err != nil {
+		return err
+	}
+
+	return writePart(destDir, mail.Header(msg.Header), msg.Body)
+}
+
+// writePart decodes a single MIME part (recursing into multipart/*) and
+// writes it to the appropriate place under destDir: body.txt/body.html
+// for inline text, attachments/<name> for everything else.
+func writePart(destDir string, header mail.Header, body io.Reader) error {
+	mediaType, params, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil {
+		mediaType = "text/plain"
+	}
+
+	body = decodeTransferEncoding(header.Get("Content-Transfer-Encoding"), body)
+
+	if strings.HasPrefix(mediaType, "multipart/") {
+		mr := multipart.NewReader(body, params["boundary"])
+		for {
+			part, err := mr.NextPart()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			if err := writePart(destDir, mail.Header(part.Header), part); err != nil {
+				return err
+			}
+		}
+	}
+
+	filename := fileNameFromHeader(header, params)
+	if filename != "" {
+		return writeAttachment(destDir, filename, body)
+	}
+
+	switch mediaType {
+	case "text/html":
+		return appendFile(path.Join(destDir, "body.html"), body)
+	default:
+		return appendFile(path.Join(destDir, "body.txt"), body)
+	}
+}
+
+func fileNameFromHeader(header mail.Header, contentTypeParams map[string]string) string {
+	if _, dispParams, err := mime.ParseMediaType(header.Get("Content-Disposition")); err == nil {
+		if name, ok := dispParams["filename"]; ok {
+			return name
+		}
+	}
+	return contentTypeParams["name"]
+}
+
+func writeAttachment(destDir, filename string, body io.Reader) error {
+	attachDir := path.Join(destDir, "attachments")
+	if err := os.MkdirAll(attachDir, 0700); err != nil {
+		return err
+	}
+
+	out, err := createUnique(attachDir, sanitizeFilename(filename))
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	_, err = io.Copy(out, body)
+	return err
+}
+
+// createUnique creates name under dir, or if that collides with an
+// existing attachment (e.g. two parts both named "image001.png"), a
+// "name-2", "name-3", ... variant instead of clobbering the earlier one.
+func createUnique(dir, name string) (*os.File, error) {
+	candidate := name
+	ext := path.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+	for i := 2; ; i++ {
+		out, err := os.OpenFile(path.Join(dir, candidate), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+		if err == nil {
+			return out, nil
+		}
+		if !os.IsExist(err) {
+			return nil, err
+		}
+		candidate = fmt.Sprintf("%s-%d%s", base, i, ext)
+	}
+}
+
+func appendFile(p string, body io.Reader) error {
+	out, err := os.OpenFile(p, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	_, err = io.Copy(out, body)
+	return err
+}
+
+func decodeTransferEncoding(encoding string, body io.Reader) io.Reader {
+	switch encoding {
+	case "base64":
+		return base64.NewDecoder(base64.StdEncoding, body)
+	case "quoted-printable":
+		return quotedprintable.NewReader(body)
+	default:
+		return body
+	}
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"io/ioutil"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestWriteAttachmentDedupesCollidingNames(t *testing.T) {
+	destDir := t.TempDir()
+
+	if err := writeAttachment(destDir, "file.bin", strings.NewReader("first")); err != nil {
+		t.Fatalf("writeAttachment: %v", err)
+	}
+	if err := writeAttachment(destDir, "file.bin", strings.NewReader("second")); err != nil {
+		t.Fatalf("writeAttachment: %v", err)
+	}
+
+	entries, err := ioutil.ReadDir(path.Join(destDir, "attachments"))
+	if err != nil {
+		t.Fatalf("reading attachments dir: %v", err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("expected 2 distinct attachment files, got %d", len(entries))
+	}
+
+	var contents []string
+	for _, entry := range entries {
+		b, err := ioutil.ReadFile(path.Join(destDir, "attachments", entry.Name()))
+		if err != nil {
+			t.Fatalf("reading %s: %v", entry.Name(), err)
+		}
+		contents = append(contents, string(b))
+	}
+	if !(contents[0] == "first" && contents[1] == "second") && !(contents[0] == "second" && contents[1] == "first") {
+		t.Errorf("expected both attachment contents preserved, got %v", contents)
+	}
+}
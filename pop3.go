@@ -0,0 +1,385 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/textproto"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// pop3State tracks the three RFC 1939 session states.
+type pop3State int
+
+const (
+	pop3Authorization pop3State = iota
+	pop3Transaction
+	pop3Update
+)
+
+// pop3Message is one file in the maildrop snapshot taken at login time.
+// Message numbers and sizes are fixed for the lifetime of the session even
+// if outputDirectory changes underneath it, per RFC 1939 section 5.
+type pop3Message struct {
+	num     int
+	path    string
+	uidl    string
+	size    int64
+	deleted bool
+}
+
+type pop3Session struct {
+	conn  net.Conn
+	tp    *textproto.Conn
+	state pop3State
+
+	user     string
+	messages []*pop3Message
+}
+
+func newPOP3Session(conn net.Conn) *pop3Session {
+	return &pop3Session{
+		conn:  conn,
+		tp:    textproto.NewConn(conn),
+		state: pop3Authorization,
+	}
+}
+
+func (s *pop3Session) reply(ok bool, msg string) error {
+	status := "+OK"
+	if !ok {
+		status = "-ERR"
+	}
+	return s.tp.PrintfLine("%s %s", status, msg)
+}
+
+func (s *pop3Session) serve() {
+	defer s.conn.Close()
+	s.reply(true, "maildump POP3 ready")
+
+	for {
+		line, err := s.tp.ReadLine()
+		if err != nil {
+			return
+		}
+		args := strings.Fields(line)
+		if len(args) == 0 {
+			s.reply(false, "malformed command")
+			continue
+		}
+		verb := strings.ToUpper(args[0])
+		rest := args[1:]
+
+		switch verb {
+		case "USER":
+			s.handleUser(rest)
+		case "PASS":
+			s.handlePass(rest)
+		case "STAT":
+			s.handleStat()
+		case "LIST":
+			s.handleList(rest)
+		case "UIDL":
+			s.handleUIDL(rest)
+		case "RETR":
+			s.handleRetr(rest)
+		case "TOP":
+			s.handleTop(rest)
+		case "DELE":
+			s.handleDele(rest)
+		case "RSET":
+			s.handleRset()
+		case "NOOP":
+			s.reply(true, "")
+		case "QUIT":
+			s.handleQuit()
+			return
+		default:
+			s.reply(false, "unknown command")
+		}
+	}
+}
+
+func (s *pop3Session) handleUser(args []string) {
+	if s.state != pop3Authorization || len(args) != 1 {
+		s.reply(false, "command not valid in this state")
+		return
+	}
+	s.user = args[0]
+	s.reply(true, "send PASS")
+}
+
+func (s *pop3Session) handlePass(args []string) {
+	if s.state != pop3Authorization || s.user == "" || len(args) != 1 {
+		s.reply(false, "command not valid in this state")
+		return
+	}
+	if !checkCredential(s.user, args[0]) {
+		s.reply(false, "authentication failed")
+		s.user = ""
+		return
+	}
+
+	messages, err := snapshotMaildrop()
+	if err != nil {
+		s.reply(false, "unable to open maildrop")
+		return
+	}
+	s.messages = messages
+	s.state = pop3Transaction
+	s.reply(true, fmt.Sprintf("%s's maildrop has %d messages", s.user, len(s.messages)))
+}
+
+func snapshotMaildrop() ([]*pop3Message, error) {
+	entries, err := ioutil.ReadDir(outputDirectory)
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+
+	var messages []*pop3Message
+	for _, entry := range entries {
+		if entry.IsDir() || strings.HasSuffix(entry.Name(), ".meta") {
+			continue
+		}
+		messages = append(messages, &pop3Message{
+			num:  len(messages) + 1,
+			path: path.Join(outputDirectory, entry.Name()),
+			uidl: entry.Name(),
+			size: entry.Size(),
+		})
+	}
+	return messages, nil
+}
+
+func (s *pop3Session) message(args []string) (*pop3Message, bool) {
+	if len(args) != 1 {
+		return nil, false
+	}
+	n, err := strconv.Atoi(args[0])
+	if err != nil || n < 1 || n > len(s.messages) {
+		return nil, false
+	}
+	msg := s.messages[n-1]
+	if msg.deleted {
+		return nil, false
+	}
+	return msg, true
+}
+
+func (s *pop3Session) handleStat() {
+	if s.state != pop3Transaction {
+		s.reply(false, "command not valid in this state")
+		return
+	}
+	var count int
+	var size int64
+	for _, msg := range s.messages {
+		if !msg.deleted {
+			count++
+			size += msg.size
+		}
+	}
+	s.reply(true, fmt.Sprintf("%d %d", count, size))
+}
+
+func (s *pop3Session) handleList(args []string) {
+	if s.state != pop3Transaction {
+		s.reply(false, "command not valid in this state")
+		return
+	}
+	if len(args) == 1 {
+		msg, ok := s.message(args)
+		if !ok {
+			s.reply(false, "no such message")
+			return
+		}
+		s.reply(true, fmt.Sprintf("%d %d", msg.num, msg.size))
+		return
+	}
+
+	s.reply(true, fmt.Sprintf("%d messages", len(s.messages)))
+	dw := s.tp.DotWriter()
+	for _, msg := range s.messages {
+		if !msg.deleted {
+			fmt.Fprintf(dw, "%d %d\r\n", msg.num, msg.size)
+		}
+	}
+	dw.Close()
+}
+
+func (s *pop3Session) handleUIDL(args []string) {
+	if s.state != pop3Transaction {
+		s.reply(false, "command not valid in this state")
+		return
+	}
+	if len(args) == 1 {
+		msg, ok := s.message(args)
+		if !ok {
+			s.reply(false, "no such message")
+			return
+		}
+		s.reply(true, fmt.Sprintf("%d %s", msg.num, msg.uidl))
+		return
+	}
+
+	s.reply(true, fmt.Sprintf("%d messages", len(s.messages)))
+	dw := s.tp.DotWriter()
+	for _, msg := range s.messages {
+		if !msg.deleted {
+			fmt.Fprintf(dw, "%d %s\r\n", msg.num, msg.uidl)
+		}
+	}
+	dw.Close()
+}
+
+func (s *pop3Session) handleRetr(args []string) {
+	if s.state != pop3Transaction {
+		s.reply(false, "command not valid in this state")
+		return
+	}
+	msg, ok := s.message(args)
+	if !ok {
+		s.reply(false, "no such message")
+		return
+	}
+	f, err := os.Open(msg.path)
+	if err != nil {
+		s.reply(false, "no such message")
+		return
+	}
+	defer f.Close()
+
+	s.reply(true, fmt.Sprintf("%d octets", msg.size))
+	dw := s.tp.DotWriter()
+	io.Copy(dw, f)
+	dw.Close()
+}
+
+func (s *pop3Session) handleTop(args []string) {
+	if s.state != pop3Transaction || len(args) != 2 {
+		s.reply(false, "command not valid in this state")
+		return
+	}
+	msg, ok := s.message(args[:1])
+	n, err := strconv.Atoi(args[1])
+	if !ok || err != nil || n < 0 {
+		s.reply(false, "no such message")
+		return
+	}
+	f, err := os.Open(msg.path)
+	if err != nil {
+		s.reply(false, "no such message")
+		return
+	}
+	defer f.Close()
+
+	tp := textproto.NewReader(bufio.NewReader(f))
+	s.reply(true, "top of message follows")
+	dw := s.tp.DotWriter()
+	defer dw.Close()
+
+	inBody := false
+	linesSent := 0
+	for {
+		line, err := tp.ReadLineBytes()
+		if err != nil {
+			return
+		}
+		if !inBody {
+			fmt.Fprintf(dw, "%s\r\n", line)
+			if len(line) == 0 {
+				inBody = true
+			}
+			continue
+		}
+		if linesSent >= n {
+			return
+		}
+		fmt.Fprintf(dw, "%s\r\n", line)
+		linesSent++
+	}
+}
+
+func (s *pop3Session) handleDele(args []string) {
+	if s.state != pop3Transaction {
+		s.reply(false, "command not valid in this state")
+		return
+	}
+	msg, ok := s.message(args)
+	if !ok {
+		s.reply(false, "no such message")
+		return
+	}
+	msg.deleted = true
+	s.reply(true, fmt.Sprintf("message %d deleted", msg.num))
+}
+
+func (s *pop3Session) handleRset() {
+	if s.state != pop3Transaction {
+		s.reply(false, "command not valid in this state")
+		return
+	}
+	for _, msg := range s.messages {
+		msg.deleted = false
+	}
+	s.reply(true, "maildrop restored")
+}
+
+func (s *pop3Session) handleQuit() {
+	if s.state == pop3Transaction {
+		for _, msg := range s.messages {
+			if msg.deleted {
+				os.Remove(msg.path)
+				os.Remove(msg.path + ".meta")
+			}
+		}
+	}
+	s.state = pop3Update
+	s.reply(true, "goodbye")
+}
+
+var pop3Port string
+var pop3TLS bool
+
+func runPOP3Server() {
+	if pop3Port == "" {
+		return
+	}
+
+	var ln net.Listener
+	var err error
+	if pop3TLS {
+		if tlsCert == "" || tlsKey == "" {
+			log.Fatal("-pop3-tls requires -tls-cert and -tls-key")
+		}
+		cert, cerr := tls.LoadX509KeyPair(tlsCert, tlsKey)
+		if cerr != nil {
+			log.Fatal(cerr)
+		}
+		ln, err = tls.Listen("tcp", pop3Port, &tls.Config{Certificates: []tls.Certificate{cert}})
+	} else {
+		ln, err = net.Listen("tcp", pop3Port)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	fmt.Println("Listening for POP3 on", pop3Port)
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			fmt.Println(err)
+			continue
+		}
+		go newPOP3Session(conn).serve()
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+)
+
+// recipientAllowlist holds the set of addresses (or *@domain wildcards)
+// that mail will actually be persisted for. When empty, every recipient
+// is accepted, matching the pre-allowlist behavior.
+var recipientAllowlist = struct {
+	sync.RWMutex
+	entries []string
+}{}
+
+func loadRecipients(path string) {
+	if path == "" {
+		return
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	defer f.Close()
+
+	var entries []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.ToLower(strings.TrimSpace(scanner.Text()))
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		entries = append(entries, line)
+	}
+
+	recipientAllowlist.Lock()
+	recipientAllowlist.entries = entries
+	recipientAllowlist.Unlock()
+}
+
+// recipientAllowed reports whether addr should be persisted. If no
+// allowlist was configured, every recipient is allowed.
+func recipientAllowed(addr string) bool {
+	recipientAllowlist.RLock()
+	entries := recipientAllowlist.entries
+	recipientAllowlist.RUnlock()
+
+	if len(entries) == 0 {
+		return true
+	}
+
+	addr = strings.ToLower(addr)
+	for _, entry := range entries {
+		if entry == addr {
+			return true
+		}
+		if domain, ok := wildcardDomain(entry); ok && strings.HasSuffix(addr, "@"+domain) {
+			return true
+		}
+	}
+	return false
+}
+
+func wildcardDomain(entry string) (string, bool) {
+	if strings.HasPrefix(entry, "*@") {
+		return entry[2:], true
+	}
+	return "", false
+}
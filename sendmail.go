@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"os"
+	"strings"
+)
+
+// sendmailMain implements just enough of sendmail(1)'s calling convention
+// (as used by mutt, cron, and git send-email) to let this binary stand in
+// for /usr/sbin/sendmail on a host that also runs `maildump serve`: read a
+// message on stdin, take recipients from the command line, and relay it
+// to a configured smarthost.
+func sendmailMain(args []string) {
+	fs := flag.NewFlagSet("sendmail", flag.ExitOnError)
+	envelopeFrom := fs.String("f", "", "envelope sender address (default: parsed from the From: header)")
+	relayHost := fs.String("relay-host", "", "smarthost to relay through, host:port")
+	relayUser := fs.String("relay-user", "", "smarthost AUTH PLAIN username")
+	relayPass := fs.String("relay-pass", "", "smarthost AUTH PLAIN password")
+	relayEnv := fs.String("relay-env", "", "file of RELAY_HOST/RELAY_USER/RELAY_PASS=... to load credentials from")
+	fs.Bool("i", true, "ignored, accepted for sendmail(1) compatibility")
+	fs.Bool("t", true, "ignored, accepted for sendmail(1) compatibility")
+	fs.Parse(args)
+
+	if *relayEnv != "" {
+		loadRelayEnv(*relayEnv, relayHost, relayUser, relayPass)
+	}
+	if *relayHost == "" {
+		log.Fatal("sendmail: -relay-host (or relay-env) is required")
+	}
+
+	raw, err := ioutil.ReadAll(os.Stdin)
+	if err != nil {
+		log.Fatalf("sendmail: reading message: %v", err)
+	}
+
+	from := *envelopeFrom
+	if from == "" {
+		from = fromHeader(raw)
+	}
+	if from == "" {
+		log.Fatal("sendmail: no -f given and no From: header in message")
+	}
+
+	recipients := fs.Args()
+	if len(recipients) == 0 {
+		log.Fatal("sendmail: no recipients given")
+	}
+
+	if err := relayMessage(*relayHost, *relayUser, *relayPass, from, recipients, raw); err != nil {
+		log.Fatalf("sendmail: %v", err)
+	}
+}
+
+func fromHeader(raw []byte) string {
+	msg, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		return ""
+	}
+	addr, err := mail.ParseAddress(msg.Header.Get("From"))
+	if err != nil {
+		return ""
+	}
+	return addr.Address
+}
+
+func loadRelayEnv(path string, host, user, pass *string) {
+	f, err := os.Open(path)
+	if err != nil {
+		log.Fatalf("sendmail: %v", err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		parts := strings.SplitN(line, "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		switch parts[0] {
+		case "RELAY_HOST":
+			*host = parts[1]
+		case "RELAY_USER":
+			*user = parts[1]
+		case "RELAY_PASS":
+			*pass = parts[1]
+		}
+	}
+}
+
+// relayMessage delivers raw to recipients via relayHost, upgrading to
+// STARTTLS and authenticating with PLAIN when credentials are configured.
+func relayMessage(relayHost, user, pass, from string, recipients []string, raw []byte) error {
+	host, _, err := net.SplitHostPort(relayHost)
+	if err != nil {
+		host = relayHost
+	}
+
+	c, err := smtp.Dial(relayHost)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	tlsOK := false
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		if err := c.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			return err
+		}
+		tlsOK = true
+	}
+
+	if user != "" {
+		if !tlsOK {
+			return fmt.Errorf("refusing to send AUTH credentials to %s: STARTTLS was not offered or did not succeed", relayHost)
+		}
+		if ok, _ := c.Extension("AUTH"); ok {
+			if err := c.Auth(smtp.PlainAuth("", user, pass, host)); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := c.Mail(from); err != nil {
+		return err
+	}
+	for _, rcpt := range recipients {
+		if err := c.Rcpt(rcpt); err != nil {
+			return err
+		}
+	}
+
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(raw); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+
+	return c.Quit()
+}